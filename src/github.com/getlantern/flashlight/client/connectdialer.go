@@ -0,0 +1,175 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/quic-go/quic-go"
+)
+
+// ConnectDialer establishes a CONNECT tunnel to addr and returns a net.Conn
+// over which pipeData can copy bytes exactly as it would for a plain TCP
+// dial. Different implementations multiplex tunnels differently: plain TCP
+// opens one connection per tunnel, while quicTunnelDialer below multiplexes
+// many tunnels over a single long-lived QUIC session to a frontend.
+type ConnectDialer interface {
+	// Name identifies the dialer, e.g. "tcp" or "quic-tunnel".
+	Name() string
+	// DialConnect opens a tunnel to addr at the given QoS. Multiplexed
+	// dialers that have no per-tunnel QoS concept ignore qos; it's only
+	// meaningful to the plain TCP dialer, which passes it straight through
+	// to the balancer.
+	DialConnect(addr string, qos int) (net.Conn, error)
+}
+
+// quicTunnelALPN is the ALPN identifier our own frontend advertises for the
+// bespoke QUIC tunnel protocol quicTunnelDialer speaks. It's deliberately
+// not "h3"/"h3-29" - those identify real HTTP/3, which this isn't, and
+// reusing them could make a peer that merely supports genuine HTTP/3 look
+// selectable here even though it has no idea about our CONNECT preamble.
+const quicTunnelALPN = "lantern-qtun"
+
+// connectDialerFor picks a ConnectDialer for a balanced peer advertising the
+// given ALPN protocols, falling back to plain TCP when the peer doesn't
+// advertise quicTunnelALPN, or the client has no frontend configured for it.
+// client.H3Frontend names the frontend host:port that terminates the
+// multiplexed session; client.FrontendTLSConfig governs the handshake with
+// it. There is no HTTP/2 extended CONNECT dialer: golang.org/x/net/http2's
+// client Transport has no supported way to send the RFC 8441 ":protocol"
+// pseudo-header extended CONNECT requires, so that path isn't implemented.
+func (client *Client) connectDialerFor(alpn []string) ConnectDialer {
+	for _, proto := range alpn {
+		if proto == quicTunnelALPN && client.H3Frontend != "" {
+			return client.h3Dialer()
+		}
+	}
+	return tcpConnectDialer{client}
+}
+
+// tcpConnectDialer is the fallback ConnectDialer: one fresh TCP connection
+// per tunnel, dialed straight from the balancer exactly like before this
+// change introduced multiplexed alternatives.
+type tcpConnectDialer struct {
+	client *Client
+}
+
+func (d tcpConnectDialer) Name() string { return "tcp" }
+
+func (d tcpConnectDialer) DialConnect(addr string, qos int) (net.Conn, error) {
+	return d.client.getBalancer().DialQOS("tcp", addr, qos)
+}
+
+// streamAddr is a net.Addr over a plain "host:port" string, used by
+// quicTunnelDialer's net.Conn adapter since a multiplexed stream has no
+// socket address of its own.
+type streamAddr string
+
+func (a streamAddr) Network() string { return "tcp" }
+func (a streamAddr) String() string  { return string(a) }
+
+// h3Dialer lazily builds and caches this Client's QUIC tunnel dialer, reusing
+// one instance so its underlying quic.Connection is actually shared across
+// tunnels.
+func (client *Client) h3Dialer() *quicTunnelDialer {
+	client.h3DialerOnce.Do(func() {
+		client.h3DialerInst = &quicTunnelDialer{
+			frontendAddr: client.H3Frontend,
+			tlsConfig:    client.FrontendTLSConfig,
+		}
+	})
+	return client.h3DialerInst
+}
+
+// quicTunnelDialer multiplexes CONNECT-style tunnels as streams on a single
+// long-lived QUIC connection to a frontend, which works better than
+// per-tunnel TCP+TLS on lossy mobile links since a single dropped packet
+// doesn't stall every tunnel sharing the connection. Despite running over
+// QUIC, this is NOT RFC 9298 HTTP/3 CONNECT-UDP: it's a bespoke preamble
+// (see DialConnect) understood only by a matching Lantern frontend, not a
+// general HTTP/3 proxy, which is also why it's dispatched on the private
+// quicTunnelALPN rather than the real h3/h3-29 ALPN identifiers.
+type quicTunnelDialer struct {
+	frontendAddr string
+	tlsConfig    *tls.Config
+
+	mu   sync.Mutex
+	conn quic.Connection
+}
+
+func (d *quicTunnelDialer) Name() string { return "quic-tunnel" }
+
+func (d *quicTunnelDialer) quicConn() (quic.Connection, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.conn != nil {
+		select {
+		case <-d.conn.Context().Done():
+			// Previous session died; fall through and redial.
+		default:
+			return d.conn, nil
+		}
+	}
+
+	conn, err := quic.DialAddr(context.Background(), d.frontendAddr, d.tlsConfig, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to dial QUIC tunnel frontend %s: %s", d.frontendAddr, err)
+	}
+	d.conn = conn
+	return conn, nil
+}
+
+func (d *quicTunnelDialer) DialConnect(addr string, qos int) (net.Conn, error) {
+	conn, err := d.quicConn()
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := conn.OpenStreamSync(context.Background())
+	if err != nil {
+		return nil, fmt.Errorf("unable to open QUIC tunnel stream to %s: %s", addr, err)
+	}
+
+	// A minimal internal preamble identifying the tunnel target; the
+	// frontend reads this line before treating the rest of the stream as
+	// raw tunneled bytes in both directions. This is our own framing, not
+	// RFC 9298 CONNECT-UDP - no generic HTTP/3 proxy would understand it.
+	if _, err := fmt.Fprintf(stream, "CONNECT %s\r\n", addr); err != nil {
+		stream.Close()
+		return nil, fmt.Errorf("unable to send CONNECT preamble to %s: %s", addr, err)
+	}
+
+	return &quicTunnelConn{Stream: stream, local: d.frontendAddr, remote: conn.RemoteAddr().String()}, nil
+}
+
+// quicTunnelConn adapts a QUIC stream to the net.Conn interface pipeData
+// expects. quic.Stream already exposes Read/Write/deadlines; only the
+// addressing, close, and half-close semantics need adapting.
+type quicTunnelConn struct {
+	quic.Stream
+	local  string
+	remote string
+}
+
+func (c *quicTunnelConn) LocalAddr() net.Addr  { return streamAddr(c.local) }
+func (c *quicTunnelConn) RemoteAddr() net.Addr { return streamAddr(c.remote) }
+
+// Close tears down both halves of the stream. quic.Stream's own Close only
+// closes the send side, leaving the read side (and the stream state backing
+// it on the shared, long-lived quic.Connection) open until the peer sends a
+// clean FIN; since callers like intercept's defer connOut.Close() expect
+// Close to fully release the conn, CancelRead is needed too so a tunnel
+// whose peer never FINs doesn't leak stream state for the life of the
+// session.
+func (c *quicTunnelConn) Close() error {
+	c.Stream.CancelRead(0)
+	return c.Stream.Close()
+}
+
+// CloseWrite half-closes the stream's send side via quic.Stream's own
+// Close, which in quic-go only closes the send side (the peer can still
+// finish writing), matching the CloseWriter contract pipeData relies on.
+func (c *quicTunnelConn) CloseWrite() error { return c.Stream.Close() }
@@ -28,36 +28,6 @@ var muConns sync.RWMutex
 var conns = make(map[net.Conn]connMeta)
 var clientConns = make(map[net.Conn]connMeta)
 
-func init() {
-	go func() {
-		ch := time.Tick(10 * time.Second)
-		for now := range ch {
-			muConns.RLock()
-			for _, meta := range conns {
-				d := now.Sub(meta.establishedAt)
-				msg := fmt.Sprintf("**********Connection to %s via %s lasted for %v", meta.hostAddr, meta.peerAddr, d)
-				if d > 10*time.Minute {
-					log.Debug(msg)
-				} else {
-					log.Trace(msg)
-				}
-			}
-			log.Debugf("**********%d connections in total", len(conns))
-			for _, meta := range clientConns {
-				d := now.Sub(meta.establishedAt)
-				msg := fmt.Sprintf("**********Client connection to %s from %s lasted for %v", meta.hostAddr, meta.peerAddr, d)
-				if d > 10*time.Minute {
-					log.Debug(msg)
-				} else {
-					log.Trace(msg)
-				}
-			}
-			log.Debugf("**********%d client connections in total", len(clientConns))
-			muConns.RUnlock()
-		}
-	}()
-}
-
 // ServeHTTP implements the method from interface http.Handler using the latest
 // handler available from getHandler() and latest ReverseProxy available from
 // getReverseProxy().
@@ -101,22 +71,25 @@ func (client *Client) intercept(resp http.ResponseWriter, req *http.Request) {
 	}()
 
 	addr := hostIncludingPort(req, 443)
-	// Establish outbound connection.
-	d := func(network, addr string) (net.Conn, error) {
-		return client.getBalancer().DialQOS("tcp", addr, client.targetQOS(req))
-	}
 
-	var connOut net.Conn
-	if runtime.GOOS == "android" || client.ProxyAll {
-		connOut, err = d("tcp", addr)
-	} else {
-		connOut, err = detour.Dialer(d)("tcp", addr)
+	if client.shouldMITM(addr) {
+		client.interceptMITM(clientConn, addr, req)
+		return
 	}
 
+	// Establish outbound connection.
+	qos := client.targetQOS(req)
+	connOut, err := client.dialWithTimeout(addr, qos, clientConn.RemoteAddr().String())
 	if err != nil {
-		respondBadGateway(clientConn, fmt.Sprintf("Unable to handle CONNECT request: %s", err))
+		recordDialError()
+		if err == errDialTimeout {
+			respondGatewayTimeout(clientConn, fmt.Sprintf("Timed out dialing %s", addr))
+		} else {
+			respondBadGateway(clientConn, fmt.Sprintf("Unable to handle CONNECT request: %s", err))
+		}
 		return
 	}
+	recordQOS(qos)
 
 	serverAddr := func() (ret string) {
 		// to avoid panic of RemoteAddr()
@@ -138,7 +111,87 @@ func (client *Client) intercept(resp http.ResponseWriter, req *http.Request) {
 	}()
 
 	// Pipe data between the client and the proxy.
-	pipeData(clientConn, connOut, req)
+	client.pipeData(clientConn, connOut, req, serverAddr)
+}
+
+// dial establishes an outbound connection to addr at the given QoS on behalf
+// of clientAddr (the inbound client's RemoteAddr). Both the HTTP CONNECT path
+// in intercept and the SOCKS5 front-end in socks.go share this so QoS
+// selection, rule resolution, and PROXY protocol emission behave identically
+// regardless of inbound protocol.
+func (client *Client) dial(addr string, qos int, clientAddr string) (net.Conn, error) {
+	return client.ruleDial(addr, qos, clientAddr)
+}
+
+// proxyDial dials addr through the balanced proxy with d (ruleDial also
+// hands it to the detour wrapper as its proxy fallback) and, if client.ProxyProtocolVersion is set, immediately writes a
+// PROXY protocol header carrying clientAddr and the dialed conn's own
+// RemoteAddr before handing the connection back. addr is the CONNECT target
+// and is frequently an unresolved hostname (e.g. "example.com:443"), which
+// isn't a valid PROXY protocol destination address; conn.RemoteAddr() is the
+// actual resolved peer the header needs to describe. It's only ever used for
+// legs that actually terminate at one of our own proxy frontends, which is
+// the only place a PROXY protocol header means anything to the peer reading
+// it.
+func (client *Client) proxyDial(d func(network, addr string) (net.Conn, error), network, addr, clientAddr string) (net.Conn, error) {
+	conn, err := d(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if client.ProxyProtocolVersion > 0 {
+		if err := client.writeProxyProtocolHeader(conn, clientAddr, conn.RemoteAddr().String()); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("unable to write PROXY protocol header: %s", err)
+		}
+	}
+
+	return conn, nil
+}
+
+// ruleDial establishes an outbound connection to addr at the given QoS. If
+// client.Rules is configured, the rule matching addr's host and port decides
+// whether to dial direct, dial the balanced proxy, dial through the detour
+// wrapper, or reject the connection outright. With no ruleset configured, it
+// falls back to the historical behavior of routing through the balancer
+// directly on Android or when ProxyAll is set, and through detour otherwise.
+// The balanced proxy leg itself goes through client.connectDialerFor, which
+// multiplexes the tunnel over QUIC to a frontend when the peer advertises
+// support for it and falls back to a fresh TCP connection from the balancer
+// otherwise. PROXY protocol headers (proxyDial) are only
+// ever written on that proxy/detour leg, never on a direct dial to the real
+// destination, which doesn't speak PROXY protocol and would mis-parse the
+// header as application data.
+func (client *Client) ruleDial(addr string, qos int, clientAddr string) (net.Conn, error) {
+	d := func(network, addr string) (net.Conn, error) {
+		return client.connectDialerFor(client.UpstreamALPN).DialConnect(addr, qos)
+	}
+	proxyD := func(network, addr string) (net.Conn, error) {
+		return client.proxyDial(d, network, addr, clientAddr)
+	}
+
+	if client.Rules != nil {
+		host, portStr, splitErr := net.SplitHostPort(addr)
+		if splitErr == nil {
+			port, _ := strconv.Atoi(portStr)
+			switch client.Rules.Resolve(host, port) {
+			case RuleReject:
+				return nil, fmt.Errorf("connection to %s blocked by rule", addr)
+			case RuleDirect:
+				return net.Dial("tcp", addr)
+			case RuleProxy:
+				return proxyD("tcp", addr)
+			case RuleDetour:
+				return detour.Dialer(proxyD)("tcp", addr)
+			}
+			// RuleUnmatched falls through to the legacy default below.
+		}
+	}
+
+	if runtime.GOOS == "android" || client.ProxyAll {
+		return proxyD("tcp", addr)
+	}
+	return detour.Dialer(proxyD)("tcp", addr)
 }
 
 // targetQOS determines the target quality of service given the X-Flashlight-QOS
@@ -158,19 +211,26 @@ func (client *Client) targetQOS(req *http.Request) int {
 
 // pipeData pipes data between the client and proxy connections.  It's also
 // responsible for responding to the initial CONNECT request with a 200 OK.
-func pipeData(clientConn net.Conn, connOut net.Conn, req *http.Request) {
+// Both directions are wrapped in counting readers/writers so the metrics
+// exposed by metrics.go (bytes in/out per upstream peer) stay accurate, and
+// in deadline-resetting readers/writers so client.IdleTimeout and
+// client.MaxTunnelDuration are enforced for as long as the tunnel is open.
+// When one direction hits EOF it half-closes its peer with CloseWrite
+// instead of fully closing it, so asymmetric request/response streams
+// (gRPC, long polls) aren't truncated by the other direction still flowing.
+func (client *Client) pipeData(clientConn net.Conn, connOut net.Conn, req *http.Request, peerAddr string) {
+	connOut = wrapConnForMetrics(connOut, peerAddr)
+	connOut = client.wrapWithTimeouts(connOut)
 
 	var wg sync.WaitGroup
 	wg.Add(1)
+	clientDone := make(chan struct{})
 	// Start piping from client to proxy
 	go func() {
 		io.Copy(connOut, clientConn)
-		// Force closing if EOF at the request half or error encountered.
-		// A bit arbitrary, but it's rather rare now to use half closing
-		// as a way to notify server. Most application closes both connections
-		// after completed send / receive so that won't cause problem.
+		closeWrite(connOut)
 		wg.Wait()
-		clientConn.Close()
+		close(clientDone)
 	}()
 
 	// Respond OK
@@ -183,6 +243,32 @@ func pipeData(clientConn net.Conn, connOut net.Conn, req *http.Request) {
 
 	// Then start coyping from proxy to client
 	io.Copy(clientConn, connOut)
+	closeWrite(clientConn)
+	// Let the client-to-proxy direction finish before returning, since the
+	// caller fully closes both connections once pipeData returns.
+	<-clientDone
+}
+
+// pipe copies data in both directions between a and b until one side EOFs or
+// errors, at which point both connections are closed. It's the protocol-
+// agnostic core of pipeData, reused by front-ends (like the SOCKS5 listener)
+// that don't speak HTTP CONNECT and so have no initial response to write.
+func pipe(a net.Conn, b net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		io.Copy(b, a)
+		a.Close()
+		b.Close()
+		wg.Done()
+	}()
+	go func() {
+		io.Copy(a, b)
+		a.Close()
+		b.Close()
+		wg.Done()
+	}()
+	wg.Wait()
 }
 
 func respondOK(writer io.Writer, req *http.Request) error {
@@ -211,6 +297,23 @@ func respondBadGateway(w io.Writer, msg string) error {
 	return err
 }
 
+// respondGatewayTimeout responds with a 504, used when the dial to the
+// destination itself exceeds client.MaxTunnelDuration rather than just
+// failing outright.
+func respondGatewayTimeout(w io.Writer, msg string) error {
+	log.Debugf("Responding GatewayTimeout: %v", msg)
+	resp := &http.Response{
+		StatusCode: http.StatusGatewayTimeout,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+	}
+	err := resp.Write(w)
+	if err == nil {
+		_, err = w.Write([]byte(msg))
+	}
+	return err
+}
+
 // hostIncludingPort extracts the host:port from a request.  It fills in a
 // a default port if none was found in the request.
 func hostIncludingPort(req *http.Request, defaultPort int) string {
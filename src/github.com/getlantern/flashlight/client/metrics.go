@@ -0,0 +1,217 @@
+package client
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// byteStats holds the running counters for one upstream peer, replacing the
+// previous "print durations every 10 seconds to the log" loop with figures
+// that can actually be scraped.
+type byteStats struct {
+	bytesIn  int64 // read from the peer, i.e. downloaded
+	bytesOut int64 // written to the peer, i.e. uploaded
+}
+
+var (
+	statsMu    sync.RWMutex
+	statsByKey = make(map[string]*byteStats)
+
+	qosMu    sync.Mutex
+	qosCount = make(map[int]int64)
+
+	dialErrors int64
+)
+
+// byteStatsFor returns the byteStats for peer, creating it on first use.
+func byteStatsFor(peer string) *byteStats {
+	statsMu.RLock()
+	s, ok := statsByKey[peer]
+	statsMu.RUnlock()
+	if ok {
+		return s
+	}
+
+	statsMu.Lock()
+	defer statsMu.Unlock()
+	if s, ok = statsByKey[peer]; ok {
+		return s
+	}
+	s = &byteStats{}
+	statsByKey[peer] = s
+	return s
+}
+
+// recordDialError tracks a failed dial attempt. The balancer peer that would
+// have served the connection isn't known at this point, and keying by the
+// requested destination instead would let statsByKey (and the Prometheus
+// label set it backs) grow without bound across arbitrary hosts, so failed
+// dials are aggregated under a single counter rather than per-destination.
+func recordDialError() {
+	atomic.AddInt64(&dialErrors, 1)
+}
+
+// recordQOS tracks how often each requested quality-of-service level is
+// used, giving operators a distribution rather than just the latest value.
+func recordQOS(qos int) {
+	qosMu.Lock()
+	qosCount[qos]++
+	qosMu.Unlock()
+}
+
+// countingConn wraps a net.Conn, attributing bytes read/written to peer's
+// byteStats so pipeData's per-connection copies roll up into per-peer
+// totals without changing its own control flow.
+type countingConn struct {
+	net.Conn
+	stats *byteStats
+}
+
+func wrapConnForMetrics(conn net.Conn, peer string) net.Conn {
+	return countingConn{conn, byteStatsFor(peer)}
+}
+
+func (c countingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	atomic.AddInt64(&c.stats.bytesIn, int64(n))
+	return n, err
+}
+
+func (c countingConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.stats.bytesOut, int64(n))
+	return n, err
+}
+
+// CloseWrite forwards to the wrapped conn if it supports half-close, so
+// wrapping a conn for metrics doesn't mask the CloseWriter capability that
+// pipeData's closeWrite relies on.
+func (c countingConn) CloseWrite() error {
+	if cw, ok := c.Conn.(CloseWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// connAges returns, for each connMeta map, the ages of its entries grouped
+// by peer address, used to compute the p50/p95 age metrics at scrape time
+// instead of maintaining a running histogram.
+func connAges(m map[net.Conn]connMeta) map[string][]time.Duration {
+	ages := make(map[string][]time.Duration)
+	now := time.Now()
+	for _, meta := range m {
+		ages[meta.peerAddr] = append(ages[meta.peerAddr], now.Sub(meta.establishedAt))
+	}
+	return ages
+}
+
+// percentile returns the nearest-rank pct-th percentile (0-100) of samples.
+// samples need not be pre-sorted.
+func percentile(samples []time.Duration, pct float64) time.Duration {
+	if len(samples) == 0 {
+		return 0
+	}
+	sorted := append([]time.Duration(nil), samples...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	idx := int(math.Ceil(pct/100*float64(len(sorted)))) - 1
+	if idx < 0 {
+		idx = 0
+	}
+	if idx >= len(sorted) {
+		idx = len(sorted) - 1
+	}
+	return sorted[idx]
+}
+
+// MetricsHandler serves connection metrics in Prometheus text exposition
+// format: per-peer byte counters, active connection counts, p50/p95 age,
+// dial errors, and the QoS distribution.
+func (client *Client) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		muConns.RLock()
+		ages := connAges(conns)
+		muConns.RUnlock()
+
+		statsMu.RLock()
+		defer statsMu.RUnlock()
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		for peer, s := range statsByKey {
+			fmt.Fprintf(w, "lantern_conn_bytes_in_total{peer=%q} %d\n", peer, atomic.LoadInt64(&s.bytesIn))
+			fmt.Fprintf(w, "lantern_conn_bytes_out_total{peer=%q} %d\n", peer, atomic.LoadInt64(&s.bytesOut))
+			fmt.Fprintf(w, "lantern_conn_active{peer=%q} %d\n", peer, int64(len(ages[peer])))
+			fmt.Fprintf(w, "lantern_conn_age_seconds{peer=%q,quantile=\"0.5\"} %f\n", peer, percentile(ages[peer], 50).Seconds())
+			fmt.Fprintf(w, "lantern_conn_age_seconds{peer=%q,quantile=\"0.95\"} %f\n", peer, percentile(ages[peer], 95).Seconds())
+		}
+		fmt.Fprintf(w, "lantern_dial_errors_total %d\n", atomic.LoadInt64(&dialErrors))
+
+		qosMu.Lock()
+		for qos, count := range qosCount {
+			fmt.Fprintf(w, "lantern_conn_qos_total{qos=\"%d\"} %d\n", qos, count)
+		}
+		qosMu.Unlock()
+	})
+}
+
+// connDump is the JSON shape served by the debug conns endpoint, letting
+// operators diagnose stuck long-lived connections without grepping logs.
+type connDump struct {
+	Host          string    `json:"host"`
+	Peer          string    `json:"peer"`
+	EstablishedAt time.Time `json:"establishedAt"`
+	Age           string    `json:"age"`
+}
+
+func dumpConns(m map[net.Conn]connMeta) []connDump {
+	now := time.Now()
+	dump := make([]connDump, 0, len(m))
+	for _, meta := range m {
+		dump = append(dump, connDump{meta.hostAddr, meta.peerAddr, meta.establishedAt, now.Sub(meta.establishedAt).String()})
+	}
+	return dump
+}
+
+// DebugConnsHandler serves the current conns and clientConns maps as JSON.
+func (client *Client) DebugConnsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		muConns.RLock()
+		out := struct {
+			Upstream []connDump `json:"upstream"`
+			Client   []connDump `json:"client"`
+		}{dumpConns(conns), dumpConns(clientConns)}
+		muConns.RUnlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(out)
+	})
+}
+
+func init() {
+	expvar.Publish("lantern_conns", expvar.Func(func() interface{} {
+		muConns.RLock()
+		defer muConns.RUnlock()
+		return struct {
+			Upstream []connDump `json:"upstream"`
+			Client   []connDump `json:"client"`
+		}{dumpConns(conns), dumpConns(clientConns)}
+	}))
+}
+
+// ServeMetrics starts an HTTP server on addr exposing /metrics (Prometheus
+// text format), /debug/vars (expvar), and /debug/conns (raw connMeta JSON
+// dump). It blocks until the listener fails.
+func (client *Client) ServeMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", client.MetricsHandler())
+	mux.Handle("/debug/vars", expvar.Handler())
+	mux.Handle("/debug/conns", client.DebugConnsHandler())
+	return http.ListenAndServe(addr, mux)
+}
@@ -0,0 +1,258 @@
+package client
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// RequestHandler inspects or rewrites a decrypted MITM request before it's
+// forwarded upstream. Returning a non-nil *http.Response short-circuits the
+// request, sending that response straight back to the client instead of
+// dialing upstream; this is how ad/tracker blocking and content-type gating
+// are implemented. Returning a nil *http.Request drops the request, closing
+// the connection, similar to goproxy's OnRequest/HandleConnect hooks.
+type RequestHandler func(req *http.Request) (*http.Request, *http.Response)
+
+// ResponseHandler inspects or rewrites a decrypted MITM response before it's
+// sent back to the client.
+type ResponseHandler func(resp *http.Response) *http.Response
+
+var (
+	hookMu        sync.RWMutex
+	requestHooks  []RequestHandler
+	responseHooks []ResponseHandler
+)
+
+// OnRequest registers a hook run, in registration order, against every
+// decrypted request passing through MITM mode.
+func (client *Client) OnRequest(handler RequestHandler) {
+	hookMu.Lock()
+	requestHooks = append(requestHooks, handler)
+	hookMu.Unlock()
+}
+
+// OnResponse registers a hook run, in registration order, against every
+// decrypted response passing through MITM mode.
+func (client *Client) OnResponse(handler ResponseHandler) {
+	hookMu.Lock()
+	responseHooks = append(responseHooks, handler)
+	hookMu.Unlock()
+}
+
+// shouldMITM reports whether the CONNECT tunnel to addr should be
+// intercepted in MITM mode rather than piped opaquely. That requires both a
+// configured CA to mint leaf certs from and a rule resolving to RuleMITM.
+func (client *Client) shouldMITM(addr string) bool {
+	if client.CA == nil || client.Rules == nil {
+		return false
+	}
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	port := 0
+	fmt.Sscanf(portStr, "%d", &port)
+	return client.Rules.Resolve(host, port) == RuleMITM
+}
+
+// interceptMITM completes a TLS handshake with the already-hijacked
+// clientConn using a leaf certificate minted for host, then decrypts each
+// request on the connection, runs it through the registered RequestHandlers,
+// dials upstream over TLS via client.dial (so QoS selection and detour still
+// apply), runs the response through the registered ResponseHandlers, and
+// re-encrypts it back to the client. It loops to support keep-alive.
+func (client *Client) interceptMITM(clientConn net.Conn, addr string, connectReq *http.Request) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	cert, err := client.leafCertFor(host)
+	if err != nil {
+		log.Errorf("Unable to generate MITM certificate for %s: %s", host, err)
+		return
+	}
+
+	// Tell the client we've established the tunnel before starting the TLS
+	// handshake inside it, exactly as the plain CONNECT path does.
+	if err := respondOK(clientConn, connectReq); err != nil {
+		log.Errorf("Unable to respond OK to CONNECT for MITM: %s", err)
+		return
+	}
+
+	tlsConn := tls.Server(clientConn, &tls.Config{
+		Certificates: []tls.Certificate{*cert},
+	})
+	defer tlsConn.Close()
+	if err := tlsConn.Handshake(); err != nil {
+		log.Debugf("MITM TLS handshake with client failed for %s: %s", host, err)
+		return
+	}
+
+	// A single shared bufio.Reader spans the whole keep-alive loop: ReadRequest
+	// reads ahead in chunks, so a fresh reader per iteration would discard any
+	// bytes of the next request it had already buffered.
+	tlsReader := bufio.NewReader(tlsConn)
+	for {
+		req, err := http.ReadRequest(tlsReader)
+		if err != nil {
+			return
+		}
+		req.URL.Scheme = "https"
+		req.URL.Host = req.Host
+		if req.URL.Host == "" {
+			req.URL.Host = host
+		}
+
+		hookMu.RLock()
+		hooks := requestHooks
+		hookMu.RUnlock()
+
+		var canned *http.Response
+		for _, hook := range hooks {
+			req, canned = hook(req)
+			if req == nil {
+				return
+			}
+			if canned != nil {
+				break
+			}
+		}
+
+		resp := canned
+		if resp == nil {
+			resp, err = client.roundTripMITM(req, clientConn.RemoteAddr().String())
+			if err != nil {
+				respondBadGateway(tlsConn, fmt.Sprintf("Unable to reach %s: %s", req.URL, err))
+				continue
+			}
+		} else {
+			// roundTripMITM's req.Write would have drained req.Body for us;
+			// since a hook short-circuited with a canned response instead,
+			// drain it ourselves so any unread body isn't mistaken for the
+			// start of the next request on tlsReader.
+			io.Copy(ioutil.Discard, req.Body)
+			req.Body.Close()
+		}
+
+		hookMu.RLock()
+		respHooks := responseHooks
+		hookMu.RUnlock()
+		for _, hook := range respHooks {
+			resp = hook(resp)
+		}
+
+		resp.Write(tlsConn)
+		if resp.Body != nil {
+			resp.Body.Close()
+		}
+		if req.Close || resp.Close {
+			return
+		}
+	}
+}
+
+// roundTripMITM dials the request's destination through client.dial (so
+// MITM traffic still gets QoS selection and detour) and performs a single
+// TLS round trip, returning the decrypted response.
+func (client *Client) roundTripMITM(req *http.Request, clientAddr string) (*http.Response, error) {
+	addr := req.URL.Host
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = addr + ":443"
+	}
+
+	conn, err := client.dial(addr, client.MinQOS, clientAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	host, _, _ := net.SplitHostPort(addr)
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: host})
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if err := req.Write(tlsConn); err != nil {
+		tlsConn.Close()
+		return nil, err
+	}
+	return http.ReadResponse(bufio.NewReader(tlsConn), req)
+}
+
+var certCacheMu sync.Mutex
+var certCache = make(map[string]*tls.Certificate)
+
+// leafCertFor returns a leaf certificate for host signed by client.CA,
+// generating and caching one on first use. Certs are cached for the life of
+// the process; client.CA is expected to remain constant while running.
+func (client *Client) leafCertFor(host string) (*tls.Certificate, error) {
+	certCacheMu.Lock()
+	defer certCacheMu.Unlock()
+
+	if cert, ok := certCache[host]; ok {
+		return cert, nil
+	}
+
+	cert, err := genLeafCert(client.CA, host)
+	if err != nil {
+		return nil, err
+	}
+	certCache[host] = cert
+	return cert, nil
+}
+
+// genLeafCert mints a leaf certificate for host, valid for one year and
+// signed by ca.
+func genLeafCert(ca *tls.Certificate, host string) (*tls.Certificate, error) {
+	caCert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse CA certificate: %s", err)
+	}
+
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{host}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, ca.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("unable to sign leaf certificate for %s: %s", host, err)
+	}
+
+	return &tls.Certificate{
+		Certificate: [][]byte{der, ca.Certificate[0]},
+		PrivateKey:  key,
+	}, nil
+}
@@ -0,0 +1,107 @@
+package client
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// PROXY protocol v2 signature and fixed header bytes, per the spec at
+// https://www.haproxy.org/download/2.8/doc/proxy-protocol.txt.
+var proxyProtoV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+const (
+	proxyProtoV2VersionCmd = 0x21 // version 2, PROXY command
+	proxyProtoV2AFInet     = 0x11 // AF_INET, STREAM
+	proxyProtoV2AFInet6    = 0x21 // AF_INET6, STREAM
+)
+
+// writeProxyProtocolHeader writes a PROXY protocol header (v1 or v2,
+// selected by client.ProxyProtocolVersion) to conn carrying clientAddr (the
+// inbound client's RemoteAddr) as the source and destAddr as the
+// destination, so Lantern upstreams can log and rate-limit by real client IP
+// when chaining through load balancers or edge proxies that support PROXY
+// protocol.
+func (client *Client) writeProxyProtocolHeader(conn net.Conn, clientAddr string, destAddr string) error {
+	switch client.ProxyProtocolVersion {
+	case 1:
+		return writeProxyProtoV1(conn, clientAddr, destAddr)
+	case 2:
+		return writeProxyProtoV2(conn, clientAddr, destAddr)
+	default:
+		return fmt.Errorf("unsupported PROXY protocol version %d", client.ProxyProtocolVersion)
+	}
+}
+
+// writeProxyProtoV1 writes a human-readable v1 header, e.g.
+// "PROXY TCP4 192.0.2.1 198.51.100.1 35000 443\r\n".
+func writeProxyProtoV1(conn net.Conn, srcAddr string, dstAddr string) error {
+	srcIP, srcPort, err := net.SplitHostPort(srcAddr)
+	if err != nil {
+		return fmt.Errorf("invalid source address %q: %s", srcAddr, err)
+	}
+	dstIP, dstPort, err := net.SplitHostPort(dstAddr)
+	if err != nil {
+		return fmt.Errorf("invalid destination address %q: %s", dstAddr, err)
+	}
+
+	proto := "TCP4"
+	if net.ParseIP(srcIP).To4() == nil {
+		proto = "TCP6"
+	}
+
+	_, err = fmt.Fprintf(conn, "PROXY %s %s %s %s %s\r\n", proto, srcIP, dstIP, srcPort, dstPort)
+	return err
+}
+
+// writeProxyProtoV2 writes a binary v2 header carrying the same source and
+// destination as writeProxyProtoV1, but in the more compact, unambiguous
+// format most modern PROXY protocol consumers prefer.
+func writeProxyProtoV2(conn net.Conn, srcAddr string, dstAddr string) error {
+	srcIP, srcPortStr, err := net.SplitHostPort(srcAddr)
+	if err != nil {
+		return fmt.Errorf("invalid source address %q: %s", srcAddr, err)
+	}
+	dstIP, dstPortStr, err := net.SplitHostPort(dstAddr)
+	if err != nil {
+		return fmt.Errorf("invalid destination address %q: %s", dstAddr, err)
+	}
+
+	src := net.ParseIP(srcIP)
+	dst := net.ParseIP(dstIP)
+	if src == nil || dst == nil {
+		return fmt.Errorf("unable to parse IPs from %q / %q", srcAddr, dstAddr)
+	}
+
+	var srcPort, dstPort uint16
+	fmt.Sscanf(srcPortStr, "%d", &srcPort)
+	fmt.Sscanf(dstPortStr, "%d", &dstPort)
+
+	header := make([]byte, 0, 28)
+	header = append(header, proxyProtoV2Signature...)
+	header = append(header, proxyProtoV2VersionCmd)
+
+	var addrBytes []byte
+	if src4, dst4 := src.To4(), dst.To4(); src4 != nil && dst4 != nil {
+		header = append(header, proxyProtoV2AFInet)
+		addrBytes = append(addrBytes, src4...)
+		addrBytes = append(addrBytes, dst4...)
+	} else {
+		header = append(header, proxyProtoV2AFInet6)
+		addrBytes = append(addrBytes, src.To16()...)
+		addrBytes = append(addrBytes, dst.To16()...)
+	}
+
+	ports := make([]byte, 4)
+	binary.BigEndian.PutUint16(ports[0:2], srcPort)
+	binary.BigEndian.PutUint16(ports[2:4], dstPort)
+	addrBytes = append(addrBytes, ports...)
+
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(addrBytes)))
+	header = append(header, length...)
+	header = append(header, addrBytes...)
+
+	_, err = conn.Write(header)
+	return err
+}
@@ -0,0 +1,187 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// RuleAction is the outcome a Rule resolves to for a matching host/port.
+type RuleAction string
+
+const (
+	// RuleDirect dials the destination directly, bypassing both the balancer
+	// and the detour wrapper.
+	RuleDirect RuleAction = "direct"
+	// RuleProxy always dials through the balanced proxy.
+	RuleProxy RuleAction = "proxy"
+	// RuleDetour dials through the detour wrapper, which falls back to
+	// proxying only when a direct dial appears to be blocked.
+	RuleDetour RuleAction = "detour"
+	// RuleReject refuses the connection outright.
+	RuleReject RuleAction = "reject"
+	// RuleMITM decrypts the CONNECT tunnel using client.CA and runs the
+	// decrypted traffic through the registered request/response hooks
+	// instead of piping opaque bytes. See mitm.go.
+	RuleMITM RuleAction = "mitm"
+	// RuleUnmatched is returned by Resolve when no rule matches; callers
+	// should fall back to their own default behavior.
+	RuleUnmatched RuleAction = ""
+)
+
+// Rule matches requests by host (regex or glob) and, optionally, by port.
+// The first Rule in a RuleSet whose Host pattern and Port both match wins.
+type Rule struct {
+	// Host is a glob (e.g. "*.doubleclick.net") or, if Regex is true, a
+	// regular expression matched against the request host.
+	Host string `json:"host" yaml:"host"`
+	// Regex indicates Host should be compiled and matched as a regular
+	// expression rather than a glob.
+	Regex bool `json:"regex" yaml:"regex"`
+	// Port restricts the rule to a single destination port. Zero matches
+	// any port.
+	Port int `json:"port" yaml:"port"`
+	// Action is the routing decision applied when this rule matches.
+	Action RuleAction `json:"action" yaml:"action"`
+
+	matcher *regexp.Regexp
+}
+
+// RuleSet is an ordered, user-configurable table of Rules consulted by
+// Client.dial before establishing an outbound connection. A matching rule
+// takes precedence over the hardcoded runtime.GOOS == "android" ||
+// client.ProxyAll branching, which still applies when no rule matches. It
+// can be loaded from YAML or JSON and hot-reloaded from disk.
+type RuleSet struct {
+	mu    sync.RWMutex
+	rules []Rule
+}
+
+// NewRuleSet builds a RuleSet from rules, compiling any regex Host patterns
+// up front so Resolve never has to.
+func NewRuleSet(rules []Rule) (*RuleSet, error) {
+	compiled := make([]Rule, len(rules))
+	for i, r := range rules {
+		if r.Regex {
+			re, err := regexp.Compile(r.Host)
+			if err != nil {
+				return nil, fmt.Errorf("invalid regex rule %q: %s", r.Host, err)
+			}
+			r.matcher = re
+		}
+		compiled[i] = r
+	}
+	return &RuleSet{rules: compiled}, nil
+}
+
+// Resolve returns the action of the first rule matching host and port, or
+// RuleUnmatched if no rule applies.
+func (rs *RuleSet) Resolve(host string, port int) RuleAction {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+
+	for _, r := range rs.rules {
+		if r.Port != 0 && r.Port != port {
+			continue
+		}
+		if r.Regex {
+			if r.matcher.MatchString(host) {
+				return r.Action
+			}
+			continue
+		}
+		if matched, _ := filepath.Match(r.Host, host); matched {
+			return r.Action
+		}
+	}
+	return RuleUnmatched
+}
+
+// replace atomically swaps in a new list of rules, used by the hot-reload
+// watcher in WatchRuleFile so readers never see a partially-updated set.
+func (rs *RuleSet) replace(rules []Rule) {
+	rs.mu.Lock()
+	rs.rules = rules
+	rs.mu.Unlock()
+}
+
+// LoadRuleFile reads a YAML or JSON rule file (selected by extension: .yaml,
+// .yml, or .json) into a RuleSet.
+func LoadRuleFile(path string) (*RuleSet, error) {
+	_, rules, err := readRuleFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return NewRuleSet(rules)
+}
+
+func readRuleFile(path string) ([]byte, []Rule, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to read rule file %s: %s", path, err)
+	}
+
+	var rules []Rule
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.Unmarshal(raw, &rules)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(raw, &rules)
+	default:
+		return nil, nil, fmt.Errorf("unrecognized rule file extension for %s", path)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to parse rule file %s: %s", path, err)
+	}
+	return raw, rules, nil
+}
+
+// WatchRuleFile loads path into a RuleSet and then polls path for changes
+// every interval, hot-reloading the rules whenever its contents change. It
+// logs and keeps the previous rules in place if a reload fails to parse, so
+// a bad edit to the file never takes effect and never crashes the client.
+// The returned RuleSet should be assigned to Client.Rules; the watcher
+// itself runs for the lifetime of the process.
+func WatchRuleFile(path string, interval time.Duration) (*RuleSet, error) {
+	raw, rules, err := readRuleFile(path)
+	if err != nil {
+		return nil, err
+	}
+	rs, err := NewRuleSet(rules)
+	if err != nil {
+		return nil, err
+	}
+
+	go func() {
+		lastRaw := raw
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			newRaw, newRules, err := readRuleFile(path)
+			if err != nil {
+				log.Debugf("Unable to reload rule file %s, keeping current rules: %s", path, err)
+				continue
+			}
+			if string(newRaw) == string(lastRaw) {
+				continue
+			}
+			compiled, err := NewRuleSet(newRules)
+			if err != nil {
+				log.Debugf("Unable to compile reloaded rule file %s, keeping current rules: %s", path, err)
+				continue
+			}
+			rs.replace(compiled.rules)
+			lastRaw = newRaw
+			log.Debugf("Reloaded %d rules from %s", len(compiled.rules), path)
+		}
+	}()
+
+	return rs, nil
+}
@@ -0,0 +1,218 @@
+package client
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// SOCKS5 protocol constants, per RFC 1928.
+const (
+	socks5Version = 0x05
+
+	socks5AuthNone = 0x00
+
+	socks5CmdConnect      = 0x01
+	socks5CmdUDPAssociate = 0x03
+
+	socks5AddrIPv4   = 0x01
+	socks5AddrDomain = 0x03
+	socks5AddrIPv6   = 0x04
+
+	socks5ReplySucceeded           = 0x00
+	socks5ReplyGeneralFailure      = 0x01
+	socks5ReplyTTLExpired          = 0x06
+	socks5ReplyCommandNotSupported = 0x07
+)
+
+// ListenAndServeSOCKS5 starts a SOCKS5 listener on addr that accepts CONNECT
+// requests (UDP ASSOCIATE and any other command are answered with "command
+// not supported") and pipes them through the same
+// client.getBalancer().DialQOS() dialer and detour wrapping used by the HTTP
+// CONNECT path in intercept. This lets SOCKS5-only clients (mobile apps,
+// curl --socks5, Tor front-ends) use Lantern without an HTTP-to-SOCKS shim.
+// It blocks until the listener is closed or Accept returns a permanent error.
+func (client *Client) ListenAndServeSOCKS5(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("Unable to listen for SOCKS5 on %s: %s", addr, err)
+	}
+	defer l.Close()
+
+	log.Debugf("Listening for SOCKS5 connections at %s", addr)
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return fmt.Errorf("Error accepting SOCKS5 connection: %s", err)
+		}
+		go client.handleSOCKS5(conn)
+	}
+}
+
+// handleSOCKS5 performs the SOCKS5 handshake on conn and, for CONNECT
+// requests, pipes data to/from the dialed upstream connection exactly like
+// intercept does for HTTP CONNECT.
+func (client *Client) handleSOCKS5(conn net.Conn) {
+	defer conn.Close()
+
+	if err := socks5Greet(conn); err != nil {
+		log.Debugf("Error in SOCKS5 greeting: %s", err)
+		return
+	}
+
+	cmd, addr, err := socks5ReadRequest(conn)
+	if err != nil {
+		log.Debugf("Error reading SOCKS5 request: %s", err)
+		return
+	}
+
+	if cmd != socks5CmdConnect {
+		// UDP ASSOCIATE is accepted at the protocol level but Lantern has no
+		// UDP relay yet, so report it as unsupported rather than silently
+		// dropping datagrams.
+		socks5WriteReply(conn, socks5ReplyCommandNotSupported, "0.0.0.0:0")
+		return
+	}
+
+	muConns.Lock()
+	clientConns[conn] = connMeta{addr, conn.RemoteAddr().String(), time.Now()}
+	muConns.Unlock()
+	defer func() {
+		muConns.Lock()
+		delete(clientConns, conn)
+		muConns.Unlock()
+	}()
+
+	connOut, err := client.dialWithTimeout(addr, client.MinQOS, conn.RemoteAddr().String())
+	if err != nil {
+		recordDialError()
+		if err == errDialTimeout {
+			socks5WriteReply(conn, socks5ReplyTTLExpired, "0.0.0.0:0")
+		} else {
+			socks5WriteReply(conn, socks5ReplyGeneralFailure, "0.0.0.0:0")
+		}
+		return
+	}
+	defer connOut.Close()
+	recordQOS(client.MinQOS)
+
+	peerAddr := connOut.RemoteAddr().String()
+	muConns.Lock()
+	conns[connOut] = connMeta{addr, peerAddr, time.Now()}
+	muConns.Unlock()
+	defer func() {
+		muConns.Lock()
+		delete(conns, connOut)
+		muConns.Unlock()
+	}()
+
+	if err := socks5WriteReply(conn, socks5ReplySucceeded, connOut.LocalAddr().String()); err != nil {
+		log.Debugf("Unable to write SOCKS5 reply: %s", err)
+		return
+	}
+
+	// Wrap connOut exactly like the HTTP CONNECT path's pipeData does, so
+	// SOCKS5 tunnels get the same per-peer byte/age metrics (metrics.go) and
+	// idle/total timeout enforcement (timeouts.go) as HTTP CONNECT tunnels,
+	// rather than being invisible to both.
+	wrapped := wrapConnForMetrics(connOut, peerAddr)
+	wrapped = client.wrapWithTimeouts(wrapped)
+	pipe(conn, wrapped)
+}
+
+// socks5Greet reads and replies to the initial SOCKS5 method-negotiation
+// message, always selecting "no authentication required".
+func socks5Greet(conn net.Conn) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[0] != socks5Version {
+		return fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return err
+	}
+	_, err := conn.Write([]byte{socks5Version, socks5AuthNone})
+	return err
+}
+
+// socks5ReadRequest reads a SOCKS5 request and returns the command and the
+// requested "host:port" destination.
+func socks5ReadRequest(conn net.Conn) (cmd byte, addr string, err error) {
+	header := make([]byte, 4)
+	if _, err = io.ReadFull(conn, header); err != nil {
+		return
+	}
+	if header[0] != socks5Version {
+		err = fmt.Errorf("unsupported SOCKS version %d", header[0])
+		return
+	}
+	cmd = header[1]
+
+	var host string
+	switch header[3] {
+	case socks5AddrIPv4:
+		ip := make([]byte, net.IPv4len)
+		if _, err = io.ReadFull(conn, ip); err != nil {
+			return
+		}
+		host = net.IP(ip).String()
+	case socks5AddrIPv6:
+		ip := make([]byte, net.IPv6len)
+		if _, err = io.ReadFull(conn, ip); err != nil {
+			return
+		}
+		host = net.IP(ip).String()
+	case socks5AddrDomain:
+		lenBuf := make([]byte, 1)
+		if _, err = io.ReadFull(conn, lenBuf); err != nil {
+			return
+		}
+		domain := make([]byte, lenBuf[0])
+		if _, err = io.ReadFull(conn, domain); err != nil {
+			return
+		}
+		host = string(domain)
+	default:
+		err = fmt.Errorf("unsupported SOCKS5 address type %d", header[3])
+		return
+	}
+
+	portBuf := make([]byte, 2)
+	if _, err = io.ReadFull(conn, portBuf); err != nil {
+		return
+	}
+	port := binary.BigEndian.Uint16(portBuf)
+	addr = net.JoinHostPort(host, fmt.Sprintf("%d", port))
+	return
+}
+
+// socks5WriteReply writes a SOCKS5 reply with the given status, always using
+// an IPv4 bound-address encoding (boundAddr's host is ignored if it isn't a
+// valid IPv4 literal, which is fine since clients generally ignore it).
+func socks5WriteReply(conn net.Conn, status byte, boundAddr string) error {
+	host, portStr, err := net.SplitHostPort(boundAddr)
+	if err != nil {
+		host, portStr = "0.0.0.0", "0"
+	}
+	ip := net.ParseIP(host).To4()
+	if ip == nil {
+		ip = net.IPv4zero.To4()
+	}
+	var port uint16
+	fmt.Sscanf(portStr, "%d", &port)
+
+	reply := make([]byte, 0, 10)
+	reply = append(reply, socks5Version, status, 0x00, socks5AddrIPv4)
+	reply = append(reply, ip...)
+	portBuf := make([]byte, 2)
+	binary.BigEndian.PutUint16(portBuf, port)
+	reply = append(reply, portBuf...)
+
+	_, err = conn.Write(reply)
+	return err
+}
@@ -0,0 +1,144 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+// errDialTimeout is returned by dialWithTimeout when client.MaxTunnelDuration
+// elapses before the dial to the destination completes.
+var errDialTimeout = errors.New("timed out dialing destination")
+
+// CloseWriter is implemented by connections (e.g. *net.TCPConn) that support
+// half-closing their write side while leaving the read side open.
+type CloseWriter interface {
+	CloseWrite() error
+}
+
+// closeWrite half-closes conn's write side if it supports CloseWriter,
+// falling back to a full Close otherwise.
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(CloseWriter); ok {
+		cw.CloseWrite()
+		return
+	}
+	conn.Close()
+}
+
+// dialWithTimeout calls client.dial, but gives up and returns errDialTimeout
+// if client.MaxTunnelDuration elapses before the dial completes. With no
+// MaxTunnelDuration configured it just delegates to dial directly.
+func (client *Client) dialWithTimeout(addr string, qos int, clientAddr string) (net.Conn, error) {
+	if client.MaxTunnelDuration <= 0 {
+		return client.dial(addr, qos, clientAddr)
+	}
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	ch := make(chan result, 1)
+	go func() {
+		conn, err := client.dial(addr, qos, clientAddr)
+		ch <- result{conn, err}
+	}()
+
+	select {
+	case r := <-ch:
+		return r.conn, r.err
+	case <-time.After(client.MaxTunnelDuration):
+		// The dial may still succeed later; when it does, close the orphaned
+		// connection rather than leaking it.
+		go func() {
+			if r := <-ch; r.conn != nil {
+				r.conn.Close()
+			}
+		}()
+		return nil, errDialTimeout
+	}
+}
+
+// deadlineConn wraps a net.Conn, resetting an idle deadline on every
+// successful read or write and additionally enforcing a fixed absolute
+// deadline for the life of the tunnel. It's how client.IdleTimeout and
+// client.MaxTunnelDuration are enforced once a CONNECT tunnel is open; an
+// idle tunnel, or one that's simply been open too long, gets its underlying
+// conn's own deadline tripped, which unblocks the pipeData io.Copy calls
+// with a timeout error exactly as if the peer had gone silent.
+type deadlineConn struct {
+	net.Conn
+	idleTimeout  time.Duration
+	hardDeadline time.Time // zero means none
+}
+
+// deadlineCapable is implemented by net.Conn adapters whose
+// SetDeadline/SetReadDeadline/SetWriteDeadline are no-ops because the
+// underlying transport has no way to honor them, so wrapWithTimeouts knows
+// not to wrap them in a deadlineConn that would silently never fire.
+type deadlineCapable interface {
+	SupportsDeadlines() bool
+}
+
+// wrapWithTimeouts wraps conn in a deadlineConn configured from
+// client.IdleTimeout and client.MaxTunnelDuration. If neither is set, conn is
+// returned unwrapped. conn is also returned unwrapped, with a log line, if it
+// implements deadlineCapable and reports false: wrapping it would produce a
+// deadlineConn whose resetDeadline calls into a no-op SetDeadline, so
+// IdleTimeout and MaxTunnelDuration would silently never be enforced.
+func (client *Client) wrapWithTimeouts(conn net.Conn) net.Conn {
+	if client.IdleTimeout <= 0 && client.MaxTunnelDuration <= 0 {
+		return conn
+	}
+
+	if dc, ok := conn.(deadlineCapable); ok && !dc.SupportsDeadlines() {
+		log.Debugf("Connection %v does not support deadlines; IdleTimeout and MaxTunnelDuration will not be enforced for it", conn.RemoteAddr())
+		return conn
+	}
+
+	dc := &deadlineConn{Conn: conn, idleTimeout: client.IdleTimeout}
+	if client.MaxTunnelDuration > 0 {
+		dc.hardDeadline = time.Now().Add(client.MaxTunnelDuration)
+	}
+	dc.resetDeadline()
+	return dc
+}
+
+func (c *deadlineConn) resetDeadline() {
+	deadline := c.hardDeadline
+	if c.idleTimeout > 0 {
+		idleDeadline := time.Now().Add(c.idleTimeout)
+		if deadline.IsZero() || idleDeadline.Before(deadline) {
+			deadline = idleDeadline
+		}
+	}
+	if !deadline.IsZero() {
+		c.Conn.SetDeadline(deadline)
+	}
+}
+
+func (c *deadlineConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if err == nil {
+		c.resetDeadline()
+	}
+	return n, err
+}
+
+func (c *deadlineConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if err == nil {
+		c.resetDeadline()
+	}
+	return n, err
+}
+
+// CloseWrite forwards to the wrapped conn if it supports half-close, so
+// deadlineConn doesn't mask the CloseWriter capability that pipeData's
+// closeWrite relies on.
+func (c *deadlineConn) CloseWrite() error {
+	if cw, ok := c.Conn.(CloseWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}